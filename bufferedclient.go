@@ -1,50 +1,238 @@
 package statsd
 
 import (
-	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quipo/statsd/event"
 )
 
-// request to close the buffered statsd collector
+// RetryPolicy controls how flush() retries a failed SendEvent before giving
+// up on that metric and counting it against Dropped.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy is a handful of doubling retries capped at a few
+// seconds, similar to the backoff Chromium's PushBuffer uses.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 500 * time.Millisecond,
+	Multiplier:   2,
+	MaxDelay:     10 * time.Second,
+}
+
+// Sample-rate support (shouldSample and the *WithSampleRate methods on
+// StatsdBuffer below) was requested for both StatsdBuffer and StatsdClient.
+// StatsdClient's source isn't part of this tree, so that half is deferred
+// rather than guessed at; add the equivalent *WithSampleRate methods there
+// once it's available to edit alongside this file.
+//
+// samplerPool hands out a per-goroutine math/rand source for sample-rate
+// decisions, so that high-frequency producers calling *WithSampleRate from
+// many goroutines don't contend on math/rand's global, mutex-guarded source.
+var samplerPool = sync.Pool{
+	New: func() interface{} { return rand.New(rand.NewSource(time.Now().UnixNano())) },
+}
+
+// shouldSample reports whether an observation taken at the given rate
+// (0 < rate <= 1) should be kept.
+func shouldSample(rate float32) bool {
+	if rate >= 1 {
+		return true
+	}
+	r := samplerPool.Get().(*rand.Rand)
+	keep := r.Float32() < rate
+	samplerPool.Put(r)
+	return keep
+}
+
+// scaleBySampleRate scales count by 1/rate and rounds to the nearest integer.
+// Rounding (rather than truncating toward zero) keeps each scaled value within
+// half a unit of count/rate: truncation always rounds down, so a stream of
+// Incr(stat, 1) calls sampled at a low rate would converge to well under the
+// true total. The scaled total is exact in expectation only when count/rate
+// is a whole number; at rate 0.3, for example, a count of 1 scales to 3.
+func scaleBySampleRate(count int64, rate float32) int64 {
+	return int64(math.Round(float64(count) / float64(rate)))
+}
+
+// request to close a shard's collector loop
 type closeRequest struct {
 	reply chan error
 }
 
+// shard owns a slice of the aggregated stats and the goroutine that merges
+// and flushes them. Splitting StatsdBuffer into shards means the map updates
+// and channel receives that used to serialize on a single collector
+// goroutine can proceed in parallel, one per shard.
+type shard struct {
+	eventChannel chan event.Event
+	events       map[string]event.Event
+	flushChannel chan struct{}
+	closeChannel chan closeRequest
+}
+
+// statsdSender is the subset of *StatsdClient's API StatsdBuffer depends on.
+// It exists so tests can substitute a fake sender instead of a real one.
+type statsdSender interface {
+	SendEvent(e event.Event) error
+	Close() error
+}
+
 // StatsdBuffer is a client library to aggregate events in memory before
 // flushing aggregates to StatsD, useful if the frequency of events is extremely high
 // and sampling is not desirable
 type StatsdBuffer struct {
-	statsd        *StatsdClient
+	statsd        statsdSender
 	flushInterval time.Duration
-	eventChannel  chan event.Event
-	events        map[string]event.Event
-	closeChannel  chan closeRequest
+	shards        []*shard
 	Logger        *log.Logger
+
+	// RetryPolicy governs how a failed SendEvent is retried during flush
+	// before the metric is given up on and counted against Dropped.
+	RetryPolicy RetryPolicy
+	// FlushThreshold triggers an extra flush as soon as a shard holds more
+	// than this many distinct stats, instead of waiting for the next tick.
+	// Zero (the default) disables it, flushing only on the interval.
+	FlushThreshold int
+	// NonBlocking makes the Incr/Timing/Gauge/... methods drop the event
+	// instead of blocking when its shard's channel is full. Dropped events
+	// are counted in Dropped and reported via the statsd.buffer.dropped
+	// gauge on the next flush.
+	NonBlocking bool
+	// SkipHistogramSamples suppresses the per-observation raw value lines a
+	// flushed Timing/Histogram/Distribution packet would otherwise include
+	// (see event.Histogram.SkipRawSamples), keeping only the aggregate
+	// summary lines. Useful for a hot stat where up to 200 raw lines per
+	// flush is more than the server needs.
+	SkipHistogramSamples bool
+
+	dropped uint64
+	sendWG  sync.WaitGroup
+	done    chan struct{}
 }
 
+// defaultEventChannelSize is the total eventChannel buffer (summed across
+// shards) used by NewStatsdBuffer. Use NewStatsdBufferWithSize to configure
+// a different size.
+const defaultEventChannelSize = 100
+
 // NewStatsdBuffer Factory
 func NewStatsdBuffer(interval time.Duration, client *StatsdClient) *StatsdBuffer {
+	return NewStatsdBufferWithSize(interval, client, defaultEventChannelSize)
+}
+
+// NewStatsdBufferWithSize is like NewStatsdBuffer but lets the caller size
+// the total event channel buffer, useful when NonBlocking is enabled and the
+// default 100 slots aren't enough to absorb bursts.
+func NewStatsdBufferWithSize(interval time.Duration, client *StatsdClient, eventChannelSize int) *StatsdBuffer {
+	return NewStatsdBufferWithShards(interval, client, eventChannelSize, runtime.GOMAXPROCS(0))
+}
+
+// NewStatsdBufferWithShards is like NewStatsdBufferWithSize but lets the
+// caller pick the number of shards backing the buffer. Each shard owns its
+// own map and goroutine, so producer throughput scales with numShards
+// instead of bottlenecking on a single collector goroutine. eventChannelSize
+// is spread evenly across the shards.
+func NewStatsdBufferWithShards(interval time.Duration, client *StatsdClient, eventChannelSize int, numShards int) *StatsdBuffer {
+	if numShards < 1 {
+		numShards = 1
+	}
+	perShardSize := eventChannelSize / numShards
+	if perShardSize < 1 {
+		perShardSize = 1
+	}
+
 	sb := &StatsdBuffer{
 		flushInterval: interval,
 		statsd:        client,
-		eventChannel:  make(chan event.Event, 100),
-		events:        make(map[string]event.Event, 0),
-		closeChannel:  make(chan closeRequest, 0),
+		shards:        make([]*shard, numShards),
 		Logger:        log.New(os.Stdout, "[BufferedStatsdClient] ", log.Ldate|log.Ltime),
+		RetryPolicy:   DefaultRetryPolicy,
+		done:          make(chan struct{}),
+	}
+
+	for i := range sb.shards {
+		s := &shard{
+			eventChannel: make(chan event.Event, perShardSize),
+			events:       make(map[string]event.Event, 0),
+			flushChannel: make(chan struct{}, 1),
+			closeChannel: make(chan closeRequest, 0),
+		}
+		sb.shards[i] = s
+		go sb.collector(s)
 	}
-	go sb.collector()
+	go sb.tickerLoop()
 	return sb
 }
 
+// tickerLoop drives per-shard flushes off a single shared ticker. A shard
+// still mid-flush simply skips that tick rather than blocking the others.
+// It exits once sb.done is closed by Close().
+func (sb *StatsdBuffer) tickerLoop() {
+	ticker := time.NewTicker(sb.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, s := range sb.shards {
+				select {
+				case s.flushChannel <- struct{}{}:
+				default:
+				}
+			}
+		case <-sb.done:
+			return
+		}
+	}
+}
+
+// shardFor picks the shard that owns key, hashing with FNV-1a so a given
+// stat always lands on the same shard.
+func (sb *StatsdBuffer) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return sb.shards[h.Sum32()%uint32(len(sb.shards))]
+}
+
+// send enqueues e on its shard, honouring NonBlocking: when enabled, a full
+// shard channel drops e and counts it against Dropped instead of blocking
+// the caller.
+func (sb *StatsdBuffer) send(e event.Event) error {
+	s := sb.shardFor(e.Key())
+	if !sb.NonBlocking {
+		s.eventChannel <- e
+		return nil
+	}
+	select {
+	case s.eventChannel <- e:
+	default:
+		atomic.AddUint64(&sb.dropped, 1)
+	}
+	return nil
+}
+
+// Dropped returns the number of metrics given up on, either because they
+// exceeded RetryPolicy.MaxAttempts or because a shard's channel was full.
+func (sb *StatsdBuffer) Dropped() uint64 {
+	return atomic.LoadUint64(&sb.dropped)
+}
+
 // Incr - Increment a counter metric. Often used to note a particular event
 func (sb *StatsdBuffer) Incr(stat string, count int64) error {
 	if 0 != count {
-		sb.eventChannel <- &event.Increment{Name: stat, Value: count}
+		return sb.send(&event.Increment{Name: stat, Value: count})
 	}
 	return nil
 }
@@ -52,82 +240,163 @@ func (sb *StatsdBuffer) Incr(stat string, count int64) error {
 // Decr - Decrement a counter metric. Often used to note a particular event
 func (sb *StatsdBuffer) Decr(stat string, count int64) error {
 	if 0 != count {
-		sb.eventChannel <- &event.Increment{Name: stat, Value: -count}
+		return sb.send(&event.Increment{Name: stat, Value: -count})
 	}
 	return nil
 }
 
-// Timing - Track a duration event
+// IncrWithSampleRate - Increment a counter metric, but only keep the
+// observation with probability rate (0 < rate <= 1). A kept observation has
+// its Value scaled by 1/rate (rounded to the nearest integer, see
+// scaleBySampleRate) to approximate the unsampled server-side total.
+func (sb *StatsdBuffer) IncrWithSampleRate(stat string, count int64, rate float32) error {
+	if 0 == count || !shouldSample(rate) {
+		return nil
+	}
+	return sb.send(&event.Increment{Name: stat, Value: scaleBySampleRate(count, rate)})
+}
+
+// newHistogram builds a Histogram event for stat/unit/value, applying rate
+// (1 for an unsampled observation) and sb.SkipHistogramSamples.
+func (sb *StatsdBuffer) newHistogram(stat, unit string, value int64, rate float32) *event.Histogram {
+	var h *event.Histogram
+	if rate >= 1 {
+		h = event.NewHistogram(stat, unit, value)
+	} else {
+		h = event.NewHistogramWithRate(stat, unit, value, rate)
+	}
+	h.SkipRawSamples = sb.SkipHistogramSamples
+	return h
+}
+
+// Timing - Track a duration event. Observations for the same stat are
+// aggregated client-side (count/min/max/sum) rather than sent one datagram
+// per call; see Histogram.
 func (sb *StatsdBuffer) Timing(stat string, delta int64) error {
-	sb.eventChannel <- event.NewTiming(stat, delta)
-	return nil
+	return sb.send(sb.newHistogram(stat, "ms", delta, 1))
+}
+
+// TimingWithSampleRate - Track a duration event, but only keep the
+// observation with probability rate (0 < rate <= 1). The rate travels with
+// the event so SendEvent can render the StatsD "|@rate" suffix.
+func (sb *StatsdBuffer) TimingWithSampleRate(stat string, delta int64, rate float32) error {
+	if !shouldSample(rate) {
+		return nil
+	}
+	return sb.send(sb.newHistogram(stat, "ms", delta, rate))
+}
+
+// Histogram - Track a histogram-family event's distribution. Like Timing,
+// observations are aggregated client-side and flushed as a single packet.
+func (sb *StatsdBuffer) Histogram(stat string, value int64) error {
+	return sb.send(sb.newHistogram(stat, "h", value, 1))
+}
+
+// HistogramWithSampleRate - Track a histogram-family event, but only keep
+// the observation with probability rate (0 < rate <= 1).
+func (sb *StatsdBuffer) HistogramWithSampleRate(stat string, value int64, rate float32) error {
+	if !shouldSample(rate) {
+		return nil
+	}
+	return sb.send(sb.newHistogram(stat, "h", value, rate))
+}
+
+// Distribution - Track a distribution-family event. Aggregated the same way
+// as Histogram, but flushed with StatsD's "d" type.
+func (sb *StatsdBuffer) Distribution(stat string, value int64) error {
+	return sb.send(sb.newHistogram(stat, "d", value, 1))
+}
+
+// DistributionWithSampleRate - Track a distribution-family event, but only
+// keep the observation with probability rate (0 < rate <= 1).
+func (sb *StatsdBuffer) DistributionWithSampleRate(stat string, value int64, rate float32) error {
+	if !shouldSample(rate) {
+		return nil
+	}
+	return sb.send(sb.newHistogram(stat, "d", value, rate))
 }
 
 // Gauge - Gauges are a constant data type. They are not subject to averaging,
 // and they don’t change unless you change them. That is, once you set a gauge value,
 // it will be a flat line on the graph until you change it again
 func (sb *StatsdBuffer) Gauge(stat string, value int64) error {
-	sb.eventChannel <- &event.Gauge{Name: stat, Value: value}
-	return nil
+	return sb.send(&event.Gauge{Name: stat, Value: value})
 }
 
 // Absolute - Send absolute-valued metric (not averaged/aggregated)
 func (sb *StatsdBuffer) Absolute(stat string, value int64) error {
-	sb.eventChannel <- &event.Absolute{Name: stat, Values: []int64{value}}
-	return nil
+	return sb.send(&event.Absolute{Name: stat, Values: []int64{value}})
 }
 
 // Total - Send a metric that is continously increasing, e.g. read operations since boot
 func (sb *StatsdBuffer) Total(stat string, value int64) error {
-	sb.eventChannel <- &event.Total{Name: stat, Value: value}
-	return nil
+	return sb.send(&event.Total{Name: stat, Value: value})
 }
 
-// handle flushes and updates in one single thread (instead of locking the events map)
-func (sb *StatsdBuffer) collector() {
+// collector handles flushes and updates for a single shard, in one goroutine
+// (instead of locking the shard's events map)
+func (sb *StatsdBuffer) collector(s *shard) {
 	// on a panic event, flush all the pending stats before panicking
-	defer func(sb *StatsdBuffer) {
+	defer func() {
 		if r := recover(); r != nil {
 			sb.Logger.Println("Caught panic, flushing stats before throwing the panic again")
-			sb.flush()
+			sb.flush(s)
 			panic(r)
 		}
-	}(sb)
-
-	ticker := time.NewTicker(sb.flushInterval)
+	}()
 
 	for {
 		select {
-		case <-ticker.C:
-			//fmt.Println("Flushing stats")
-			sb.flush()
-		case e := <-sb.eventChannel:
-			//fmt.Println("Received ", e.String())
-			if e2, ok := sb.events[e.Key()]; ok {
-				//fmt.Println("Updating existing event")
+		case e := <-s.eventChannel:
+			if e2, ok := s.events[e.Key()]; ok {
 				e2.Update(e)
-				sb.events[e.Key()] = e2
+				s.events[e.Key()] = e2
 			} else {
-				//fmt.Println("Adding new event")
-				sb.events[e.Key()] = e
+				s.events[e.Key()] = e
 			}
-		case c := <-sb.closeChannel:
-			sb.Logger.Println("Asked to terminate. Flushing stats before returning.")
-			c.reply <- sb.flush()
-			break
+			if sb.FlushThreshold > 0 && len(s.events) > sb.FlushThreshold {
+				sb.flush(s)
+			}
+		case <-s.flushChannel:
+			sb.flush(s)
+		case c := <-s.closeChannel:
+			c.reply <- sb.flush(s)
+			return
 		}
 	}
 }
 
-// Close sends a close event to the collector asking to stop & flush pending stats
-// and closes the statsd client
+// Close asks every shard's collector to stop & flush pending stats, waits
+// for them all to drain, and closes the statsd client
 func (sb *StatsdBuffer) Close() (err error) {
-	// 1. send a close event to the collector
-	req := closeRequest{reply: make(chan error, 0)}
-	sb.closeChannel <- req
-	// 2. wait for the collector to drain the queue and respond
-	err = <-req.reply
-	// 3. close the statsd client
+	// 1. stop tickerLoop so it doesn't leak past Close()
+	close(sb.done)
+
+	// 2. send a close request to every shard and wait for each to drain & reply
+	var wg sync.WaitGroup
+	wg.Add(len(sb.shards))
+	errs := make([]error, len(sb.shards))
+	for i, s := range sb.shards {
+		go func(i int, s *shard) {
+			defer wg.Done()
+			req := closeRequest{reply: make(chan error, 0)}
+			s.closeChannel <- req
+			errs[i] = <-req.reply
+		}(i, s)
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			err = e
+		}
+	}
+
+	// 3. wait for any sends (and their retry backoff) still in flight from
+	// the shards' final flush to finish, so we don't close the client out
+	// from under them
+	sb.sendWG.Wait()
+
+	// 4. close the statsd client
 	err2 := sb.statsd.Close()
 	if err != nil {
 		return err
@@ -135,23 +404,56 @@ func (sb *StatsdBuffer) Close() (err error) {
 	return err2
 }
 
-// send the events to StatsD and reset them.
+// send a shard's events to StatsD and reset them.
 // This function is NOT thread-safe, so it must only be invoked synchronously
-// from within the collector() goroutine
-func (sb *StatsdBuffer) flush() (err error) {
-	var wg sync.WaitGroup
-	wg.Add(len(sb.events))
-	for k, v := range sb.events {
+// from within that shard's collector() goroutine.
+//
+// Sends (and their retry backoff) run in their own goroutines that flush
+// does not wait on, so a slow or down StatsD instance never blocks the
+// collector from draining eventChannel on the next tick. Close() waits on
+// sb.sendWG instead, so pending retries still get a chance to finish before
+// the underlying client is closed.
+func (sb *StatsdBuffer) flush(s *shard) (err error) {
+	if s == sb.shards[0] {
+		if dropped := atomic.LoadUint64(&sb.dropped); dropped > 0 {
+			s.events["statsd.buffer.dropped"] = &event.Gauge{Name: "statsd.buffer.dropped", Value: int64(dropped)}
+		}
+	}
+
+	for k, v := range s.events {
+		sb.sendWG.Add(1)
 		go func(e event.Event) {
-			err := sb.statsd.SendEvent(e)
-			if nil != err {
-				fmt.Println(err)
-			}
-			wg.Done()
+			defer sb.sendWG.Done()
+			sb.sendWithRetry(e)
 		}(v)
-		//fmt.Println("Sent", v.String())
-		delete(sb.events, k)
+		delete(s.events, k)
 	}
-	wg.Wait()
 	return nil
 }
+
+// sendWithRetry sends e, retrying with exponential backoff per sb.RetryPolicy
+// on failure. If every attempt fails, the metric is dropped and Dropped is
+// incremented rather than retried forever.
+func (sb *StatsdBuffer) sendWithRetry(e event.Event) {
+	policy := sb.RetryPolicy
+	if policy.MaxAttempts <= 0 {
+		policy = DefaultRetryPolicy
+	}
+	delay := policy.InitialDelay
+	var err error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if err = sb.statsd.SendEvent(e); err == nil {
+			return
+		}
+		if attempt == policy.MaxAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay = time.Duration(float64(delay) * policy.Multiplier)
+		if delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+	atomic.AddUint64(&sb.dropped, 1)
+	sb.Logger.Printf("Giving up on %s after %d attempts: %s", e.String(), policy.MaxAttempts, err)
+}
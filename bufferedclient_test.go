@@ -0,0 +1,243 @@
+package statsd
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quipo/statsd/event"
+)
+
+// fakeSender is a statsdSender that fails its first N calls to SendEvent
+// before succeeding, so retry/backoff behaviour can be tested without a real
+// network connection.
+type fakeSender struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	sent     []event.Event
+}
+
+func (f *fakeSender) SendEvent(e event.Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("boom")
+	}
+	f.sent = append(f.sent, e)
+	return nil
+}
+
+func (f *fakeSender) Close() error { return nil }
+
+func (f *fakeSender) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeSender) sentEvents() []event.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]event.Event, len(f.sent))
+	copy(out, f.sent)
+	return out
+}
+
+// newTestStatsdBuffer builds a StatsdBuffer wired to sender instead of a real
+// *StatsdClient, mirroring NewStatsdBufferWithShards. It exists only for
+// tests, since the public constructors take a concrete *StatsdClient.
+func newTestStatsdBuffer(interval time.Duration, sender statsdSender, numShards int) *StatsdBuffer {
+	sb := &StatsdBuffer{
+		flushInterval: interval,
+		statsd:        sender,
+		shards:        make([]*shard, numShards),
+		Logger:        log.New(ioutil.Discard, "", 0),
+		RetryPolicy:   DefaultRetryPolicy,
+		done:          make(chan struct{}),
+	}
+	for i := range sb.shards {
+		s := &shard{
+			eventChannel: make(chan event.Event, 100),
+			events:       make(map[string]event.Event, 0),
+			flushChannel: make(chan struct{}, 1),
+			closeChannel: make(chan closeRequest, 0),
+		}
+		sb.shards[i] = s
+		go sb.collector(s)
+	}
+	go sb.tickerLoop()
+	return sb
+}
+
+func TestScaleBySampleRate(t *testing.T) {
+	cases := []struct {
+		count int64
+		rate  float32
+		want  int64
+	}{
+		{count: 1, rate: 0.3, want: 3}, // 1/0.3 = 3.33 -> rounds to 3
+		{count: 2, rate: 0.3, want: 7}, // 2/0.3 = 6.67 -> rounds to 7
+		{count: 1, rate: 0.5, want: 2},
+		{count: 5, rate: 1, want: 5},
+	}
+	for _, c := range cases {
+		if got := scaleBySampleRate(c.count, c.rate); got != c.want {
+			t.Errorf("scaleBySampleRate(%d, %v) = %d, want %d", c.count, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestSendWithRetrySucceedsAfterFailures(t *testing.T) {
+	f := &fakeSender{failures: 2}
+	sb := &StatsdBuffer{
+		statsd: f,
+		Logger: log.New(ioutil.Discard, "", 0),
+		RetryPolicy: RetryPolicy{
+			MaxAttempts:  5,
+			InitialDelay: time.Millisecond,
+			Multiplier:   2,
+			MaxDelay:     10 * time.Millisecond,
+		},
+	}
+
+	sb.sendWithRetry(&event.Increment{Name: "foo", Value: 1})
+
+	if got := f.callCount(); got != 3 {
+		t.Fatalf("expected 3 attempts (2 failures + 1 success), got %d", got)
+	}
+	if got := sb.Dropped(); got != 0 {
+		t.Fatalf("expected Dropped() == 0 after an eventual success, got %d", got)
+	}
+}
+
+func TestSendWithRetryDropsAfterMaxAttempts(t *testing.T) {
+	f := &fakeSender{failures: 100}
+	sb := &StatsdBuffer{
+		statsd: f,
+		Logger: log.New(ioutil.Discard, "", 0),
+		RetryPolicy: RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: time.Millisecond,
+			Multiplier:   2,
+			MaxDelay:     5 * time.Millisecond,
+		},
+	}
+
+	sb.sendWithRetry(&event.Increment{Name: "foo", Value: 1})
+
+	if got := f.callCount(); got != 3 {
+		t.Fatalf("expected exactly MaxAttempts (3) attempts, got %d", got)
+	}
+	if got := sb.Dropped(); got != 1 {
+		t.Fatalf("expected Dropped() == 1 after exhausting retries, got %d", got)
+	}
+}
+
+// TestFlushDoesNotBlockCollectorDuringRetryBackoff guards against flush()
+// waiting synchronously on sendWithRetry's backoff sleeps: if it did, a
+// shard's collector goroutine would stall for the whole retry sequence and
+// stop draining eventChannel, defeating NonBlocking send.
+func TestFlushDoesNotBlockCollectorDuringRetryBackoff(t *testing.T) {
+	f := &fakeSender{failures: 1000}
+	sb := newTestStatsdBuffer(time.Hour, f, 1)
+	sb.NonBlocking = true
+	sb.RetryPolicy = RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: 50 * time.Millisecond,
+		Multiplier:   2,
+		MaxDelay:     50 * time.Millisecond,
+	}
+	defer sb.Close()
+
+	if err := sb.Incr("foo", 1); err != nil {
+		t.Fatalf("Incr returned error: %v", err)
+	}
+	sb.shards[0].flushChannel <- struct{}{}
+	time.Sleep(10 * time.Millisecond) // let the flush start its retry backoff
+
+	// Send more events than the shard's channel holds: a collector stalled
+	// in the retry backoff would leave the channel full and drop the overflow.
+	for i := 0; i <= cap(sb.shards[0].eventChannel); i++ {
+		if err := sb.Incr("bar", 1); err != nil {
+			t.Fatalf("Incr returned error: %v", err)
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if got := sb.Dropped(); got != 0 {
+		t.Fatalf("Incr was dropped while a retry was backing off, collector must be blocked: Dropped()=%d", got)
+	}
+}
+
+// TestShardingAggregatesSameKey checks that repeated events for the same stat,
+// sent from many goroutines at once, are all merged and flushed without loss
+// when the buffer has several shards. It does not look at which shard holds
+// the stat or how many flushes it takes to drain the events: it only requires
+// the sent totals for the stat to add up to n.
+func TestShardingAggregatesSameKey(t *testing.T) {
+	f := &fakeSender{}
+	sb := newTestStatsdBuffer(time.Hour, f, 4)
+	defer sb.Close()
+
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			sb.Incr("same.stat", 1)
+		}()
+	}
+	wg.Wait()
+
+	// Keep nudging every shard to flush until the events it already has
+	// queued are all merged and sent: a single flush signal can race ahead
+	// of the collector still draining eventChannel into its map.
+	deadline := time.Now().Add(500 * time.Millisecond)
+	var total int64
+	for time.Now().Before(deadline) {
+		for _, s := range sb.shards {
+			select {
+			case s.flushChannel <- struct{}{}:
+			default:
+			}
+		}
+		total = 0
+		for _, e := range f.sentEvents() {
+			if inc, ok := e.(*event.Increment); ok && inc.Key() == "same.stat" {
+				total += inc.Value
+			}
+		}
+		if total == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("same.stat never aggregated to %d, got %d", n, total)
+}
+
+// TestCloseStopsBackgroundGoroutines verifies Close() leaves no tickerLoop or
+// collector goroutines running behind it.
+func TestCloseStopsBackgroundGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	sb := newTestStatsdBuffer(5*time.Millisecond, &fakeSender{}, 3)
+	if err := sb.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Fatalf("goroutines leaked after Close: before=%d after=%d", before, got)
+	}
+}
@@ -0,0 +1,129 @@
+package event
+
+import "fmt"
+
+// maxHistogramSamples bounds the raw-value window kept on a Histogram so a
+// single hot stat can't grow the buffered packet without limit between
+// flushes. It's a sliding window of the most recently observed values, not a
+// uniform sample of the whole flush period, so it's biased toward whatever
+// arrived last.
+const maxHistogramSamples = 200
+
+// sample is a single raw observation folded into a Histogram, tagged with
+// the rate it was recorded at so mixing sampled and unsampled calls for the
+// same stat doesn't lose the information needed to render each one's
+// StatsD "|@rate" suffix correctly.
+type sample struct {
+	Value int64
+	Rate  float32
+}
+
+// Histogram is a client-side aggregate of a timing/histogram/distribution
+// metric. Rather than emitting one datagram per observation, StatsdBuffer
+// folds observations for the same stat into a Histogram (count, min, max,
+// sum and sum-of-squares) plus a bounded window of the most recent raw
+// values, and flushes the result as a single packet.
+type Histogram struct {
+	Name       string
+	Unit       string // StatsD type suffix for raw samples: "ms", "h" or "d"
+	Count      int64
+	Min        int64
+	Max        int64
+	Sum        int64
+	SumSquares int64
+	samples    []sample
+
+	// SkipRawSamples suppresses the per-observation raw value lines Stats()
+	// would otherwise render (up to maxHistogramSamples of them), keeping
+	// only the five aggregate summary lines. Useful for a hot stat where the
+	// raw lines add more flush volume than the server needs.
+	SkipRawSamples bool
+}
+
+// NewHistogram builds a single-observation Histogram event for stat, tagged
+// with the given StatsD unit ("ms" for Timing, "h" for Histogram, "d" for
+// Distribution).
+func NewHistogram(stat, unit string, value int64) *Histogram {
+	return NewHistogramWithRate(stat, unit, value, 1)
+}
+
+// NewHistogramWithRate builds a single-observation Histogram event that was
+// recorded at the given sample rate (0 < rate <= 1). The rate is carried
+// through to Stats() as a StatsD "|@rate" suffix rather than being folded
+// into Sum/Count, since the server side is expected to do that scaling.
+func NewHistogramWithRate(stat, unit string, value int64, rate float32) *Histogram {
+	return &Histogram{
+		Name:       stat,
+		Unit:       unit,
+		Count:      1,
+		Min:        value,
+		Max:        value,
+		Sum:        value,
+		SumSquares: value * value,
+		samples:    []sample{{Value: value, Rate: rate}},
+	}
+}
+
+// Update merges another Histogram's observations into this one. Each raw
+// sample keeps the rate it was originally recorded at, so Histograms built
+// from calls at different sample rates (or a mix of sampled and unsampled
+// calls) can still be merged without losing that per-sample information.
+func (h *Histogram) Update(e2 Event) error {
+	h2, ok := e2.(*Histogram)
+	if !ok {
+		return fmt.Errorf("Failed to Update: Histogram expected, found %T", e2)
+	}
+	h.Count += h2.Count
+	h.Sum += h2.Sum
+	h.SumSquares += h2.SumSquares
+	if h2.Min < h.Min {
+		h.Min = h2.Min
+	}
+	if h2.Max > h.Max {
+		h.Max = h2.Max
+	}
+	h.samples = append(h.samples, h2.samples...)
+	if len(h.samples) > maxHistogramSamples {
+		h.samples = h.samples[len(h.samples)-maxHistogramSamples:]
+	}
+	return nil
+}
+
+// Stats returns one StatsD line per summary statistic, plus the retained raw
+// samples (each with its own "|@rate" suffix, if any) so percentiles can
+// still be derived server-side, unless SkipRawSamples suppresses them.
+func (h *Histogram) Stats() []string {
+	stats := make([]string, 0, 5+len(h.samples))
+	stats = append(stats,
+		fmt.Sprintf("%s.count:%d|c", h.Name, h.Count),
+		fmt.Sprintf("%s.min:%d|g", h.Name, h.Min),
+		fmt.Sprintf("%s.max:%d|g", h.Name, h.Max),
+		fmt.Sprintf("%s.sum:%d|g", h.Name, h.Sum),
+		fmt.Sprintf("%s.sumsq:%d|g", h.Name, h.SumSquares),
+	)
+	if h.SkipRawSamples {
+		return stats
+	}
+	for _, s := range h.samples {
+		if s.Rate > 0 && s.Rate < 1 {
+			stats = append(stats, fmt.Sprintf("%s:%d|%s|@%g", h.Name, s.Value, h.Unit, s.Rate))
+			continue
+		}
+		stats = append(stats, fmt.Sprintf("%s:%d|%s", h.Name, s.Value, h.Unit))
+	}
+	return stats
+}
+
+// Key returns the name of the metric, unchanged
+func (h *Histogram) Key() string { return h.Name }
+
+// SetKey modifies the key value
+func (h *Histogram) SetKey(key string) { h.Name = key }
+
+func (h *Histogram) String() string {
+	return fmt.Sprintf("%s:%d|%s (buffered count=%d min=%d max=%d sum=%d sumsq=%d)",
+		h.Name, h.Count, h.Unit, h.Count, h.Min, h.Max, h.Sum, h.SumSquares)
+}
+
+// TypeString returns the statsd type string of this event
+func (h *Histogram) TypeString() string { return "Histogram" }
@@ -0,0 +1,139 @@
+package event
+
+import (
+	"strings"
+	"testing"
+)
+
+// fakeEvent is a minimal Event implementation, used only to verify that
+// Histogram.Update rejects events of the wrong concrete type.
+type fakeEvent struct{ name string }
+
+func (f *fakeEvent) Update(e Event) error { return nil }
+func (f *fakeEvent) Stats() []string      { return nil }
+func (f *fakeEvent) Key() string          { return f.name }
+func (f *fakeEvent) SetKey(key string)    { f.name = key }
+func (f *fakeEvent) String() string       { return f.name }
+func (f *fakeEvent) TypeString() string   { return "fake" }
+
+func containsLine(lines []string, target string) bool {
+	for _, l := range lines {
+		if l == target {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewHistogramWithRateSingleObservation(t *testing.T) {
+	h := NewHistogramWithRate("foo", "ms", 10, 0.5)
+
+	if h.Count != 1 || h.Min != 10 || h.Max != 10 || h.Sum != 10 || h.SumSquares != 100 {
+		t.Fatalf("unexpected single-observation histogram: %+v", h)
+	}
+
+	stats := h.Stats()
+	if !containsLine(stats, "foo.count:1|c") {
+		t.Errorf("missing count line, got %v", stats)
+	}
+	if !containsLine(stats, "foo.sumsq:100|g") {
+		t.Errorf("missing sumsq line, got %v", stats)
+	}
+	if !containsLine(stats, "foo:10|ms|@0.5") {
+		t.Errorf("missing rated raw sample line, got %v", stats)
+	}
+}
+
+func TestHistogramUpdateMergesCountMinMaxSumSumSquares(t *testing.T) {
+	h := NewHistogram("foo", "ms", 10)
+
+	if err := h.Update(NewHistogram("foo", "ms", 20)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := h.Update(NewHistogram("foo", "ms", 5)); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	if h.Count != 3 {
+		t.Errorf("Count = %d, want 3", h.Count)
+	}
+	if h.Min != 5 {
+		t.Errorf("Min = %d, want 5", h.Min)
+	}
+	if h.Max != 20 {
+		t.Errorf("Max = %d, want 20", h.Max)
+	}
+	if h.Sum != 35 {
+		t.Errorf("Sum = %d, want 35", h.Sum)
+	}
+	if want := int64(100 + 400 + 25); h.SumSquares != want {
+		t.Errorf("SumSquares = %d, want %d", h.SumSquares, want)
+	}
+}
+
+func TestHistogramUpdateRejectsWrongType(t *testing.T) {
+	h := NewHistogram("foo", "ms", 1)
+	if err := h.Update(&fakeEvent{name: "bar"}); err == nil {
+		t.Fatal("expected Update to reject a non-Histogram event")
+	}
+}
+
+func TestHistogramUpdatePreservesPerSampleRate(t *testing.T) {
+	h := NewHistogram("foo", "ms", 10) // unsampled, rate 1
+	sampled := NewHistogramWithRate("foo", "ms", 20, 0.1)
+
+	if err := h.Update(sampled); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	stats := h.Stats()
+	if !containsLine(stats, "foo:10|ms") {
+		t.Errorf("expected the unsampled raw value without a rate suffix, got %v", stats)
+	}
+	if !containsLine(stats, "foo:20|ms|@0.1") {
+		t.Errorf("expected the sampled raw value to keep its own |@0.1 suffix, got %v", stats)
+	}
+}
+
+func TestHistogramUpdateBoundsSampleWindow(t *testing.T) {
+	h := NewHistogram("foo", "ms", 0)
+	for i := int64(1); i <= int64(maxHistogramSamples)+50; i++ {
+		if err := h.Update(NewHistogram("foo", "ms", i)); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+
+	var rawLines int
+	for _, s := range h.Stats() {
+		if strings.HasPrefix(s, "foo:") {
+			rawLines++
+		}
+		if s == "foo:0|ms" {
+			t.Fatalf("expected the oldest sample to have been evicted, found %q", s)
+		}
+	}
+	if rawLines != maxHistogramSamples {
+		t.Fatalf("expected raw sample lines capped at %d, got %d", maxHistogramSamples, rawLines)
+	}
+}
+
+func TestHistogramSkipRawSamplesSuppressesRawLines(t *testing.T) {
+	h := NewHistogram("foo", "ms", 10)
+	h.SkipRawSamples = true
+
+	stats := h.Stats()
+	if len(stats) != 5 {
+		t.Fatalf("expected only the 5 summary lines, got %v", stats)
+	}
+	if containsLine(stats, "foo:10|ms") {
+		t.Fatalf("expected the raw sample line to be suppressed, got %v", stats)
+	}
+}
+
+func TestHistogramString(t *testing.T) {
+	h := NewHistogram("foo", "ms", 10)
+	want := "foo:1|ms (buffered count=1 min=10 max=10 sum=10 sumsq=100)"
+	if got := h.String(); got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+}